@@ -0,0 +1,99 @@
+package deferred
+
+import (
+	"sync"
+	"time"
+)
+
+// FailureReport summarizes one or more failures that shared the same key,
+// as produced by a notifyAggregator.
+type FailureReport struct {
+	Description string
+	Count       int
+	FirstSeen   time.Time
+	LastSeen    time.Time
+}
+
+// default values populating notification aggregation
+const (
+	DefaultAggregateMinDelay = time.Second * 5
+	DefaultAggregateMaxDelay = time.Minute
+)
+
+// DefaultNotifyKey groups failures by their error message.
+var DefaultNotifyKey = func(err error) string { return err.Error() }
+
+// notifyAggregator groups errors reported through notify by key, delaying
+// the first flush of a new batch by minDelay so that duplicate errors can
+// accumulate, but never holding a batch open longer than maxDelay.
+type notifyAggregator struct {
+	key      func(error) string
+	minDelay time.Duration
+	maxDelay time.Duration
+	flush    func([]FailureReport)
+
+	mu       sync.Mutex
+	reports  map[string]*FailureReport
+	debounce *time.Timer
+	maxTimer *time.Timer
+}
+
+func newNotifyAggregator(key func(error) string, minDelay, maxDelay time.Duration, flush func([]FailureReport)) *notifyAggregator {
+	return &notifyAggregator{
+		key:      key,
+		minDelay: minDelay,
+		maxDelay: maxDelay,
+		flush:    flush,
+		reports:  make(map[string]*FailureReport),
+	}
+}
+
+func (a *notifyAggregator) notify(err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	k := a.key(err)
+	r, ok := a.reports[k]
+	if !ok {
+		r = &FailureReport{Description: err.Error(), FirstSeen: now}
+		a.reports[k] = r
+	}
+	r.Count++
+	r.LastSeen = now
+
+	if a.debounce != nil {
+		a.debounce.Stop()
+	}
+	a.debounce = time.AfterFunc(a.minDelay, a.doFlush)
+
+	if a.maxTimer == nil {
+		a.maxTimer = time.AfterFunc(a.maxDelay, a.doFlush)
+	}
+}
+
+func (a *notifyAggregator) doFlush() {
+	a.mu.Lock()
+	if len(a.reports) == 0 {
+		a.mu.Unlock()
+		return
+	}
+
+	reports := make([]FailureReport, 0, len(a.reports))
+	for _, r := range a.reports {
+		reports = append(reports, *r)
+	}
+	a.reports = make(map[string]*FailureReport)
+
+	if a.debounce != nil {
+		a.debounce.Stop()
+		a.debounce = nil
+	}
+	if a.maxTimer != nil {
+		a.maxTimer.Stop()
+		a.maxTimer = nil
+	}
+	a.mu.Unlock()
+
+	a.flush(reports)
+}
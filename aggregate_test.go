@@ -0,0 +1,148 @@
+package deferred
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNotifyAggregatorFlushesAfterMinDelayQuiet(t *testing.T) {
+	var mu sync.Mutex
+	var flushes [][]FailureReport
+
+	agg := newNotifyAggregator(DefaultNotifyKey, 20*time.Millisecond, time.Second, func(reports []FailureReport) {
+		mu.Lock()
+		flushes = append(flushes, reports)
+		mu.Unlock()
+	})
+
+	agg.notify(errors.New("boom"))
+	agg.notify(errors.New("boom"))
+	agg.notify(errors.New("boom"))
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		n := len(flushes)
+		mu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(flushes) != 1 {
+		t.Fatalf("got %d flushes, want 1", len(flushes))
+	}
+	reports := flushes[0]
+	if len(reports) != 1 {
+		t.Fatalf("got %d reports, want 1 (deduped by key)", len(reports))
+	}
+	if reports[0].Description != "boom" || reports[0].Count != 3 {
+		t.Fatalf("report = %+v, want Description=boom Count=3", reports[0])
+	}
+}
+
+func TestNotifyAggregatorDedupesByKey(t *testing.T) {
+	var mu sync.Mutex
+	var flushes [][]FailureReport
+
+	agg := newNotifyAggregator(DefaultNotifyKey, 10*time.Millisecond, time.Second, func(reports []FailureReport) {
+		mu.Lock()
+		flushes = append(flushes, reports)
+		mu.Unlock()
+	})
+
+	agg.notify(errors.New("a"))
+	agg.notify(errors.New("b"))
+	agg.notify(errors.New("a"))
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		n := len(flushes)
+		mu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(flushes) != 1 || len(flushes[0]) != 2 {
+		t.Fatalf("got flushes %+v, want a single flush with 2 distinct keys", flushes)
+	}
+	byDesc := map[string]FailureReport{}
+	for _, r := range flushes[0] {
+		byDesc[r.Description] = r
+	}
+	if byDesc["a"].Count != 2 {
+		t.Fatalf(`report "a".Count = %d, want 2`, byDesc["a"].Count)
+	}
+	if byDesc["b"].Count != 1 {
+		t.Fatalf(`report "b".Count = %d, want 1`, byDesc["b"].Count)
+	}
+}
+
+func TestNotifyAggregatorCappedByMaxDelay(t *testing.T) {
+	var mu sync.Mutex
+	var flushes [][]FailureReport
+
+	agg := newNotifyAggregator(DefaultNotifyKey, time.Hour, 20*time.Millisecond, func(reports []FailureReport) {
+		mu.Lock()
+		flushes = append(flushes, reports)
+		mu.Unlock()
+	})
+
+	// minDelay is an hour, so only maxDelay can flush this batch. Keep
+	// notifying faster than maxDelay so the debounce alone would never fire.
+	stop := time.Now().Add(60 * time.Millisecond)
+	for time.Now().Before(stop) {
+		agg.notify(errors.New("boom"))
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(flushes) == 0 {
+		t.Fatal("got no flushes, want maxDelay to have forced at least one")
+	}
+}
+
+func TestNotifyAggregatorCustomKey(t *testing.T) {
+	var mu sync.Mutex
+	var flushes [][]FailureReport
+
+	agg := newNotifyAggregator(func(error) string { return "same-key" }, 10*time.Millisecond, time.Second, func(reports []FailureReport) {
+		mu.Lock()
+		flushes = append(flushes, reports)
+		mu.Unlock()
+	})
+
+	agg.notify(errors.New("one"))
+	agg.notify(errors.New("two"))
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		n := len(flushes)
+		mu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(flushes) != 1 || len(flushes[0]) != 1 {
+		t.Fatalf("got flushes %+v, want a single flush with 1 report grouped by the custom key", flushes)
+	}
+	if flushes[0][0].Count != 2 {
+		t.Fatalf("report.Count = %d, want 2", flushes[0][0].Count)
+	}
+}
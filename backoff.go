@@ -0,0 +1,136 @@
+package deferred
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Stop is returned by Backoff.NextInterval to indicate that no further
+// retries should be attempted, for example because a maximum elapsed time
+// has been exceeded.
+const Stop time.Duration = -1
+
+// Backoff determines how long to wait before the next attempt at creating
+// a handler. Implementations may track their own state (e.g. the number of
+// attempts made so far) between calls.
+type Backoff interface {
+	// NextInterval returns the duration to wait before the next attempt, or
+	// Stop if no further attempts should be made.
+	NextInterval() time.Duration
+	// Reset restores the backoff to its initial state.
+	Reset()
+}
+
+// default values populating an exponential Backoff
+const (
+	DefaultInitialInterval     = time.Second
+	DefaultMultiplier          = 2.0
+	DefaultMaxInterval         = time.Minute
+	DefaultMaxElapsedTime      = 0 // zero disables the elapsed time limit
+	DefaultRandomizationFactor = 0.5
+)
+
+// exponentialBackoff grows the retry interval geometrically between
+// attempts up to maxInterval, applying randomization factor jitter, and
+// signals Stop once maxElapsedTime has passed since it was last Reset.
+type exponentialBackoff struct {
+	initialInterval     time.Duration
+	multiplier          float64
+	maxInterval         time.Duration
+	maxElapsedTime      time.Duration
+	randomizationFactor float64
+
+	current time.Duration
+	start   time.Time
+}
+
+// ExponentialBackoffConfig customizes a Backoff returned by
+// NewExponentialBackoff.
+type ExponentialBackoffConfig func(*exponentialBackoff)
+
+// WithInitialInterval sets the interval used before the first retry
+// attempt.
+func WithInitialInterval(v time.Duration) ExponentialBackoffConfig {
+	return func(b *exponentialBackoff) { b.initialInterval = v }
+}
+
+// WithMultiplier sets the factor the interval is multiplied by after each
+// attempt.
+func WithMultiplier(v float64) ExponentialBackoffConfig {
+	return func(b *exponentialBackoff) { b.multiplier = v }
+}
+
+// WithMaxInterval caps the interval returned by NextInterval.
+func WithMaxInterval(v time.Duration) ExponentialBackoffConfig {
+	return func(b *exponentialBackoff) { b.maxInterval = v }
+}
+
+// WithMaxElapsedTime causes NextInterval to return Stop once the given
+// duration has passed since the backoff was created or last Reset. The
+// default, zero, disables the limit.
+func WithMaxElapsedTime(v time.Duration) ExponentialBackoffConfig {
+	return func(b *exponentialBackoff) { b.maxElapsedTime = v }
+}
+
+// WithRandomizationFactor sets the jitter applied to each interval, as a
+// fraction between 0 and 1: an interval of d is randomized to a value in
+// `d * (1 ± randomizationFactor)`.
+func WithRandomizationFactor(v float64) ExponentialBackoffConfig {
+	return func(b *exponentialBackoff) { b.randomizationFactor = v }
+}
+
+// NewExponentialBackoff returns a Backoff that increases the retry interval
+// exponentially between attempts.
+func NewExponentialBackoff(configs ...ExponentialBackoffConfig) Backoff {
+	b := &exponentialBackoff{
+		initialInterval:     DefaultInitialInterval,
+		multiplier:          DefaultMultiplier,
+		maxInterval:         DefaultMaxInterval,
+		maxElapsedTime:      DefaultMaxElapsedTime,
+		randomizationFactor: DefaultRandomizationFactor,
+	}
+	for _, c := range configs {
+		c(b)
+	}
+	b.Reset()
+	return b
+}
+
+func (b *exponentialBackoff) Reset() {
+	b.current = b.initialInterval
+	b.start = time.Now()
+}
+
+func (b *exponentialBackoff) NextInterval() time.Duration {
+	if b.maxElapsedTime > 0 && time.Since(b.start) > b.maxElapsedTime {
+		return Stop
+	}
+
+	interval := randomize(b.current, b.randomizationFactor)
+
+	b.current = time.Duration(float64(b.current) * b.multiplier)
+	if b.current > b.maxInterval {
+		b.current = b.maxInterval
+	}
+
+	return interval
+}
+
+// randomize scales d by a random factor in [1-factor, 1+factor].
+func randomize(d time.Duration, factor float64) time.Duration {
+	if factor <= 0 {
+		return d
+	}
+	delta := factor * float64(d)
+	min := float64(d) - delta
+	max := float64(d) + delta
+	return time.Duration(min + rand.Float64()*(max-min))
+}
+
+// constantBackoff always returns the same interval; it backs WithRetryAfter.
+type constantBackoff struct {
+	interval time.Duration
+}
+
+func (c constantBackoff) NextInterval() time.Duration { return c.interval }
+func (c constantBackoff) Reset()                      {}
@@ -0,0 +1,88 @@
+package deferred
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExponentialBackoffCapsAtMaxInterval(t *testing.T) {
+	b := NewExponentialBackoff(
+		WithInitialInterval(10*time.Millisecond),
+		WithMultiplier(2),
+		WithMaxInterval(35*time.Millisecond),
+		WithRandomizationFactor(0),
+	)
+
+	want := []time.Duration{
+		10 * time.Millisecond,
+		20 * time.Millisecond,
+		35 * time.Millisecond,
+		35 * time.Millisecond,
+	}
+	for i, w := range want {
+		if got := b.NextInterval(); got != w {
+			t.Fatalf("NextInterval() #%d = %v, want %v", i, got, w)
+		}
+	}
+}
+
+func TestExponentialBackoffResetRestartsFromInitialInterval(t *testing.T) {
+	b := NewExponentialBackoff(
+		WithInitialInterval(10*time.Millisecond),
+		WithMultiplier(2),
+		WithMaxInterval(time.Second),
+		WithRandomizationFactor(0),
+	)
+
+	b.NextInterval()
+	b.NextInterval()
+	b.Reset()
+
+	if got := b.NextInterval(); got != 10*time.Millisecond {
+		t.Fatalf("NextInterval() after Reset = %v, want %v", got, 10*time.Millisecond)
+	}
+}
+
+func TestExponentialBackoffStopsAfterMaxElapsedTime(t *testing.T) {
+	b := NewExponentialBackoff(
+		WithInitialInterval(time.Millisecond),
+		WithMaxElapsedTime(20*time.Millisecond),
+	)
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if b.NextInterval() == Stop {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("NextInterval never returned Stop once maxElapsedTime had passed")
+}
+
+func TestExponentialBackoffRandomizationFactorBounds(t *testing.T) {
+	const factor = 0.5
+	const initial = 100 * time.Millisecond
+	min := time.Duration(float64(initial) * (1 - factor))
+	max := time.Duration(float64(initial) * (1 + factor))
+
+	for i := 0; i < 50; i++ {
+		b := NewExponentialBackoff(
+			WithInitialInterval(initial),
+			WithRandomizationFactor(factor),
+		)
+		got := b.NextInterval()
+		if got < min || got > max {
+			t.Fatalf("NextInterval() = %v, want within [%v, %v]", got, min, max)
+		}
+	}
+}
+
+func TestConstantBackoffNeverVaries(t *testing.T) {
+	b := constantBackoff{interval: 5 * time.Second}
+	for i := 0; i < 3; i++ {
+		if got := b.NextInterval(); got != 5*time.Second {
+			t.Fatalf("NextInterval() #%d = %v, want %v", i, got, 5*time.Second)
+		}
+	}
+	b.Reset() // no-op, must not panic
+}
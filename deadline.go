@@ -0,0 +1,91 @@
+package deferred
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// deadlineManager notifies registered waiters once they have been waiting
+// longer than a fixed timeout, using a single timer for all of them instead
+// of one per waiter. Because every registration uses the same timeout,
+// deadlines are monotonically increasing, so the earliest one is always at
+// the front of entries.
+type deadlineManager struct {
+	timeout time.Duration
+
+	mu      sync.Mutex
+	entries *list.List // of *deadlineEntry, ordered by deadline ascending
+	timer   *time.Timer
+}
+
+type deadlineEntry struct {
+	deadline time.Time
+	notify   chan struct{}
+}
+
+func newDeadlineManager(timeout time.Duration) *deadlineManager {
+	return &deadlineManager{timeout: timeout, entries: list.New()}
+}
+
+// register returns a channel that is closed once the manager's timeout has
+// elapsed since register was called. Callers that no longer care, because
+// they were served or gave up for another reason, must call cancel to
+// release the entry.
+func (m *deadlineManager) register() (notify <-chan struct{}, cancel func()) {
+	m.mu.Lock()
+	// deadline must be read under the lock: PushBack order is only
+	// deadline-ascending if concurrent registrations can't race each other
+	// between computing time.Now() and acquiring mu.
+	entry := &deadlineEntry{deadline: time.Now().Add(m.timeout), notify: make(chan struct{})}
+	elem := m.entries.PushBack(entry)
+	m.resetTimerLocked()
+	m.mu.Unlock()
+
+	return entry.notify, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.entries.Remove(elem)
+		m.resetTimerLocked()
+	}
+}
+
+// resetTimerLocked reschedules the single timer to fire for the entry at
+// the front of the list, if any. Callers must hold m.mu.
+func (m *deadlineManager) resetTimerLocked() {
+	if m.timer != nil {
+		m.timer.Stop()
+		m.timer = nil
+	}
+	front := m.entries.Front()
+	if front == nil {
+		return
+	}
+	m.timer = time.AfterFunc(time.Until(front.Value.(*deadlineEntry).deadline), m.fire)
+}
+
+// fire closes the notify channel of every entry whose deadline has passed
+// and reschedules the timer for whatever remains.
+func (m *deadlineManager) fire() {
+	m.mu.Lock()
+	now := time.Now()
+	var expired []*deadlineEntry
+	for {
+		front := m.entries.Front()
+		if front == nil {
+			break
+		}
+		entry := front.Value.(*deadlineEntry)
+		if entry.deadline.After(now) {
+			break
+		}
+		expired = append(expired, entry)
+		m.entries.Remove(front)
+	}
+	m.resetTimerLocked()
+	m.mu.Unlock()
+
+	for _, entry := range expired {
+		close(entry.notify)
+	}
+}
@@ -1,36 +1,99 @@
 package deferred
 
 import (
+	"container/list"
 	"context"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// deferredHandler queues requests received while the real handler is not
+// ready into a bounded FIFO, and replays them through a small pool of
+// workers once it becomes ready. Once ready, it serves requests directly.
 type deferredHandler struct {
 	sync.Mutex
+	cond    *sync.Cond
+	ready   bool
+	closed  bool
 	handler http.Handler
+
+	queue           *list.List // of *pendingRequest
+	maxQueue        int
+	queueFullStatus int
+	deadlines       *deadlineManager
+
+	state    atomic.Int32 // State, accessed atomically
+	attempts atomic.Int32
+	lastErr  atomic.Value // holds an errBox
 }
 
 func (h *deferredHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	h.Lock()
-	c := h.handler
+	ready, c := h.ready, h.handler
 	h.Unlock()
-	c.ServeHTTP(w, r)
+	if ready {
+		c.ServeHTTP(w, r)
+		return
+	}
+
+	pr := &pendingRequest{w: w, r: r, done: make(chan struct{})}
+	elem, ok := h.enqueue(pr)
+	if !ok {
+		http.Error(w, "too many requests queued while handler is pending", h.queueFullStatus)
+		return
+	}
+
+	notify, cancel := h.deadlines.register()
+	select {
+	case <-pr.done:
+		cancel()
+	case <-notify:
+		h.dequeue(elem)
+		pr.once.Do(func() {
+			http.Error(w, "timed out waiting for handler to be created and sent", http.StatusServiceUnavailable)
+		})
+	case <-r.Context().Done():
+		cancel()
+		h.dequeue(elem)
+	}
 }
 
-func newRepeater() (func(http.Handler), <-chan http.Handler) {
-	receive, repeat := make(chan http.Handler), make(chan http.Handler)
-	go func() {
-		v := <-receive
-		close(receive)
-		for {
-			repeat <- v
-		}
-	}()
-	return func(next http.Handler) {
-		receive <- next
-	}, repeat
+// setHandler installs next as the currently serving handler. ready controls
+// whether requests are now served directly (true, used both when create
+// succeeds and when it permanently fails over to failedHandler) or continue
+// to be queued (false). Demotion after failed WithRevalidate cycles does not
+// go through setHandler; it uses demote, which leaves the handler in place.
+// Waiting workers are only woken when ready transitions to true, since
+// that's the only case in which there is newly-servable work for them.
+func (h *deferredHandler) setHandler(next http.Handler, ready bool) {
+	h.Lock()
+	h.handler, h.ready = next, ready
+	h.Unlock()
+	if ready {
+		h.cond.Broadcast()
+	}
+}
+
+// demote marks the handler as not ready, so subsequent requests are queued
+// again instead of being served directly. It does not clear the currently
+// installed handler, which a worker may still be part-way through serving;
+// it is only replaced once a later revalidation succeeds.
+func (h *deferredHandler) demote() {
+	h.Lock()
+	h.ready = false
+	h.Unlock()
+}
+
+// close marks h as shut down, waking every worker blocked in cond.Wait so
+// they can observe closed and return. It is called once NewHandler's ctx is
+// done, so a handler built with a short-lived context doesn't outlive it.
+func (h *deferredHandler) close() {
+	h.Lock()
+	h.closed = true
+	h.Unlock()
+	h.cond.Broadcast()
 }
 
 func failedHandler(w http.ResponseWriter, r *http.Request) {
@@ -39,23 +102,42 @@ func failedHandler(w http.ResponseWriter, r *http.Request) {
 
 // default values populating options objects
 const (
-	DefaultRetryAfter   = time.Second * 10
-	DefaultTimeoutAfter = time.Second * 15
+	DefaultRetryAfter      = time.Second * 10
+	DefaultTimeoutAfter    = time.Second * 15
+	DefaultMaxQueue        = 1024
+	DefaultQueueFullStatus = http.StatusServiceUnavailable
+	DefaultRefreshInterval = time.Second * 30
 )
 
 // DefaultNotify does nothing with the passed error
 var DefaultNotify = func(error) {}
 
 type options struct {
-	notify                   func(error)
-	timeoutAfter, retryAfter time.Duration
+	notify           func(error)
+	timeoutAfter     time.Duration
+	newBackoff       func() Backoff
+	maxQueue         int
+	queueFullStatus  int
+	revalidate       func() (http.Handler, error)
+	refreshInterval  time.Duration
+	refreshOnError   RefreshOnErrorPolicy
+	notifyKey        func(error) string
+	aggregatedNotify func([]FailureReport)
+	aggMinDelay      time.Duration
+	aggMaxDelay      time.Duration
 }
 
 func newOptions(configs ...Config) options {
 	o := options{
-		notify:       DefaultNotify,
-		retryAfter:   DefaultRetryAfter,
-		timeoutAfter: DefaultTimeoutAfter,
+		notify:          DefaultNotify,
+		newBackoff:      func() Backoff { return constantBackoff{DefaultRetryAfter} },
+		timeoutAfter:    DefaultTimeoutAfter,
+		maxQueue:        DefaultMaxQueue,
+		queueFullStatus: DefaultQueueFullStatus,
+		refreshInterval: DefaultRefreshInterval,
+		notifyKey:       DefaultNotifyKey,
+		aggMinDelay:     DefaultAggregateMinDelay,
+		aggMaxDelay:     DefaultAggregateMaxDelay,
 	}
 	for _, c := range configs {
 		o = c(o)
@@ -68,10 +150,22 @@ func newOptions(configs ...Config) options {
 type Config func(options) options
 
 // WithRetryAfter returns a Config that will ensure the given duration
-// is used as the interval for retrying handler creation
+// is used as a constant interval for retrying handler creation. It is a
+// shortcut for WithBackoff with a Backoff that never varies the interval.
 func WithRetryAfter(v time.Duration) Config {
 	return func(o options) options {
-		o.retryAfter = v
+		o.newBackoff = func() Backoff { return constantBackoff{v} }
+		return o
+	}
+}
+
+// WithBackoff returns a Config that will ensure the Backoff returned by the
+// given factory is used to determine the interval between handler creation
+// attempts. The factory is called once per NewHandler invocation so that
+// each handler gets its own, freshly reset, Backoff.
+func WithBackoff(newBackoff func() Backoff) Config {
+	return func(o options) options {
+		o.newBackoff = newBackoff
 		return o
 	}
 }
@@ -85,6 +179,33 @@ func WithNotify(n func(error)) Config {
 	}
 }
 
+// WithNotifyKey returns a Config that sets the function used to group
+// failures for WithAggregatedNotify. Errors for which key returns the same
+// string are counted into the same FailureReport. It has no effect unless
+// WithAggregatedNotify is also used. The default groups by err.Error().
+func WithNotifyKey(key func(error) string) Config {
+	return func(o options) options {
+		o.notifyKey = key
+		return o
+	}
+}
+
+// WithAggregatedNotify returns a Config that, in addition to the raw
+// per-error path installed via WithNotify, groups failures by key (see
+// WithNotifyKey) and periodically calls fn with one FailureReport per
+// distinct key seen since the last flush. The first flush of a new batch
+// is delayed by minDelay so that duplicate errors have a chance to
+// accumulate before anything is reported, but a batch is never held open
+// longer than maxDelay.
+func WithAggregatedNotify(fn func([]FailureReport), minDelay, maxDelay time.Duration) Config {
+	return func(o options) options {
+		o.aggregatedNotify = fn
+		o.aggMinDelay = minDelay
+		o.aggMaxDelay = maxDelay
+		return o
+	}
+}
+
 // WithTimeoutAfter returns a Config that will ensure the pending handler
 // will timeout after the given duration
 func WithTimeoutAfter(v time.Duration) Config {
@@ -94,55 +215,149 @@ func WithTimeoutAfter(v time.Duration) Config {
 	}
 }
 
-// NewHandler returns a new http.Handler that will try to queue requests until the
-// handler creation succeeded. On a failed creation attempt the notify function
-// will be called with the error returned by `create` if it is configured.
-// In case the passed context is cancelled before a handler could be created,
-// retrying will be terminated and the handler will permanently return 503.
-func NewHandler(ctx context.Context, create func() (http.Handler, error), configs ...Config) http.Handler {
+// WithMaxQueue returns a Config that bounds the number of requests buffered
+// while the real handler is pending. Requests received once the queue is
+// full are rejected immediately with the status set via
+// WithQueueFullStatus instead of being buffered.
+func WithMaxQueue(n int) Config {
+	return func(o options) options {
+		o.maxQueue = n
+		return o
+	}
+}
+
+// WithQueueFullStatus returns a Config that sets the HTTP status code
+// returned to requests rejected because the pending queue is full, for
+// example http.StatusTooManyRequests.
+func WithQueueFullStatus(code int) Config {
+	return func(o options) options {
+		o.queueFullStatus = code
+		return o
+	}
+}
+
+// WithRevalidate returns a Config that, once the handler has been created
+// successfully, periodically calls the given function to re-validate it.
+// Whenever revalidate returns a new http.Handler without error, it is
+// atomically swapped in to serve subsequent requests; the currently
+// serving handler is left untouched on error. This turns the otherwise
+// one-shot handler into a long-lived, self-healing wrapper suitable for
+// handlers whose backends (DB pools, upstream clients) may need
+// reconstruction over time. See WithRefreshInterval and
+// WithRefreshOnError to control its cadence and failure handling.
+func WithRevalidate(revalidate func() (http.Handler, error)) Config {
+	return func(o options) options {
+		o.revalidate = revalidate
+		return o
+	}
+}
+
+// WithRefreshInterval returns a Config that sets the interval at which the
+// function passed to WithRevalidate is called. It has no effect unless
+// WithRevalidate is also used.
+func WithRefreshInterval(v time.Duration) Config {
+	return func(o options) options {
+		o.refreshInterval = v
+		return o
+	}
+}
+
+// RefreshOnErrorPolicy controls how repeated WithRevalidate failures are
+// handled. A single failed revalidation never tears down the currently
+// serving handler.
+type RefreshOnErrorPolicy struct {
+	// MaxConsecutiveFailures is the number of consecutive revalidation
+	// failures after which the handler is demoted back to StatePending,
+	// queueing requests again until a later revalidation succeeds. Zero,
+	// the default, disables demotion: failures are only reported via
+	// WithNotify (and WithAggregatedNotify, if configured) and the last
+	// good handler keeps serving indefinitely.
+	MaxConsecutiveFailures int
+}
+
+// WithRefreshOnError returns a Config that sets the policy applied to
+// consecutive WithRevalidate failures. It has no effect unless
+// WithRevalidate is also used.
+func WithRefreshOnError(policy RefreshOnErrorPolicy) Config {
+	return func(o options) options {
+		o.refreshOnError = policy
+		return o
+	}
+}
+
+// NewHandler returns a new Handler that will try to queue requests until the
+// handler creation succeeded. Between attempts it waits for the interval
+// returned by the configured Backoff (a constant interval by default, see
+// WithRetryAfter and WithBackoff). On a failed creation attempt the notify
+// function will be called with the error returned by `create` if it is
+// configured. In case the passed context is cancelled, or the Backoff
+// signals Stop, before a handler could be created, retrying will be
+// terminated and the handler will permanently return 503. The returned
+// Handler's State, LastError and Attempts methods expose this lifecycle,
+// and its ReadinessHandler can be mounted as a readiness probe. Once ctx is
+// done, the queue workers and, if WithRevalidate is configured, the
+// refresh goroutine also exit, so the handler doesn't leak goroutines past
+// the lifetime of ctx.
+func NewHandler(ctx context.Context, create func() (http.Handler, error), configs ...Config) Handler {
 	opts := newOptions(configs...)
-	send, updateHandler := newRepeater()
+	if opts.aggregatedNotify != nil {
+		agg := newNotifyAggregator(opts.notifyKey, opts.aggMinDelay, opts.aggMaxDelay, opts.aggregatedNotify)
+		rawNotify := opts.notify
+		opts.notify = func(err error) {
+			rawNotify(err)
+			agg.notify(err)
+		}
+	}
 
-	h := deferredHandler{
-		handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			select {
-			case h := <-updateHandler:
-				h.ServeHTTP(w, r)
-			case <-time.NewTimer(opts.timeoutAfter).C:
-				http.Error(w, "timed out waiting for handler to be created and sent", http.StatusServiceUnavailable)
-			}
-		}),
+	h := &deferredHandler{
+		queue:           list.New(),
+		maxQueue:        opts.maxQueue,
+		queueFullStatus: opts.queueFullStatus,
+		deadlines:       newDeadlineManager(opts.timeoutAfter),
+	}
+	h.cond = sync.NewCond(&h.Mutex)
+
+	for i := 0; i < queueWorkers; i++ {
+		go h.worker()
 	}
 
 	go func() {
-		next := <-updateHandler
-		h.Lock()
-		h.handler = next
-		h.Unlock()
+		<-ctx.Done()
+		h.close()
 	}()
 
 	go func() {
-		schedule := make(chan time.Time)
-		go func() {
-			for t := time.Tick(opts.retryAfter); true; <-t {
-				schedule <- time.Now()
-			}
-		}()
+		backoff := opts.newBackoff()
 		for {
+			interval := backoff.NextInterval()
+			if interval == Stop {
+				h.state.Store(int32(StateFailed))
+				h.setHandler(http.HandlerFunc(failedHandler), true)
+				return
+			}
+
 			select {
 			case <-ctx.Done():
-				send(http.HandlerFunc(failedHandler))
+				h.state.Store(int32(StateFailed))
+				h.setHandler(http.HandlerFunc(failedHandler), true)
 				return
-			case <-schedule:
-				next, err := create()
-				if err == nil {
-					send(next)
-					return
+			case <-time.After(interval):
+			}
+
+			h.attempts.Add(1)
+			next, err := create()
+			if err == nil {
+				h.state.Store(int32(StateReady))
+				h.setHandler(next, true)
+				if opts.revalidate != nil {
+					go h.refresh(ctx, opts)
 				}
-				opts.notify(err)
+				return
 			}
+			h.lastErr.Store(errBox{err})
+			opts.notify(err)
 		}
 	}()
 
-	return &h
-}
\ No newline at end of file
+	return h
+}
@@ -0,0 +1,81 @@
+package deferred
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+)
+
+// queueWorkers is the number of goroutines draining the pending request
+// queue once the real handler becomes available.
+const queueWorkers = 8
+
+// pendingRequest is a request received while the real handler is still
+// being created, buffered until it can be replayed.
+type pendingRequest struct {
+	w    http.ResponseWriter
+	r    *http.Request
+	done chan struct{}
+	once sync.Once
+}
+
+// worker waits for the handler to be ready and the queue to hold a request,
+// then replays requests against whatever handler is current. A request
+// whose context was already cancelled by the time it is dequeued is dropped
+// without ever reaching the real handler. While the handler is not ready
+// (still pending, or demoted by a failed WithRevalidate cycle), workers
+// block instead of draining the queue, so buffered requests wait for a
+// handler rather than being served against a stale or absent one. worker
+// returns once h is closed, so it doesn't outlive the context NewHandler
+// was given.
+func (h *deferredHandler) worker() {
+	for {
+		h.Lock()
+		for !h.closed && (!h.ready || h.queue.Len() == 0) {
+			h.cond.Wait()
+		}
+		if h.closed {
+			h.Unlock()
+			return
+		}
+		front := h.queue.Front()
+		h.queue.Remove(front)
+		pr := front.Value.(*pendingRequest)
+		c := h.handler
+		h.Unlock()
+
+		if pr.r.Context().Err() != nil {
+			continue
+		}
+
+		pr.once.Do(func() {
+			c.ServeHTTP(pr.w, pr.r)
+			close(pr.done)
+		})
+	}
+}
+
+// enqueue admits pr into the pending queue, returning the list element and
+// true, or false if the queue is already at its configured capacity. The
+// caller must later call dequeue with the returned element if it gives up
+// waiting (timed out, or its context was cancelled) so the slot is
+// reclaimed immediately rather than lingering until a worker gets to it. A
+// request that was served needs no dequeue: the worker already removed it.
+func (h *deferredHandler) enqueue(pr *pendingRequest) (*list.Element, bool) {
+	h.Lock()
+	defer h.Unlock()
+	if h.queue.Len() >= h.maxQueue {
+		return nil, false
+	}
+	elem := h.queue.PushBack(pr)
+	h.cond.Signal()
+	return elem, true
+}
+
+// dequeue removes elem from the pending queue if it is still there. It is
+// safe to call even if a worker already popped elem itself.
+func (h *deferredHandler) dequeue(elem *list.Element) {
+	h.Lock()
+	h.queue.Remove(elem)
+	h.Unlock()
+}
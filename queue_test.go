@@ -0,0 +1,88 @@
+package deferred
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestQueueReclaimsCapacityOnTimeout reproduces the scenario from the
+// review: a create() that never returns, and a burst of requests that all
+// give up waiting. Because workers only drain the queue once the handler
+// becomes ready, capacity must be reclaimed as soon as each request times
+// out rather than left for a worker to eventually collect.
+func TestQueueReclaimsCapacityOnTimeout(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+
+	h := NewHandler(context.Background(), func() (http.Handler, error) {
+		<-block
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), nil
+	},
+		WithMaxQueue(2),
+		WithTimeoutAfter(20*time.Millisecond),
+		WithQueueFullStatus(http.StatusTooManyRequests),
+	)
+
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Fatalf("request %d: got status %d, want %d (timed out)", i, rec.Code, http.StatusServiceUnavailable)
+		}
+	}
+
+	// Both slots should have been reclaimed the moment their requests timed
+	// out. A brand new request must be admitted and itself time out, not be
+	// rejected outright because the queue still looks full.
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d, want %d (queue should have had room)", rec.Code, http.StatusServiceUnavailable)
+	}
+}
+
+// TestQueueReclaimsCapacityOnContextCancel covers the other give-up path:
+// a request whose own context is cancelled, rather than timing out against
+// WithTimeoutAfter, must also free its slot immediately.
+func TestQueueReclaimsCapacityOnContextCancel(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+
+	h := NewHandler(context.Background(), func() (http.Handler, error) {
+		<-block
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), nil
+	},
+		WithMaxQueue(1),
+		WithTimeoutAfter(200*time.Millisecond),
+		WithQueueFullStatus(http.StatusTooManyRequests),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		close(done)
+	}()
+
+	// Give the request a chance to be admitted into the queue before
+	// cancelling it.
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("ServeHTTP never returned after its context was cancelled")
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code == http.StatusTooManyRequests {
+		t.Fatalf("got status %d, want queue to have reclaimed the cancelled request's slot", rec.Code)
+	}
+}
@@ -0,0 +1,43 @@
+package deferred
+
+import (
+	"context"
+	"time"
+)
+
+// refresh periodically calls opts.revalidate and atomically swaps in
+// whatever new handler it produces. A single failed revalidation never
+// disturbs the currently serving handler; only
+// opts.refreshOnError.MaxConsecutiveFailures consecutive failures, if
+// configured, demote the handler back to StatePending so requests are
+// queued again until a later revalidation succeeds. refresh returns once
+// ctx is done, so it doesn't outlive the context NewHandler was given.
+func (h *deferredHandler) refresh(ctx context.Context, opts options) {
+	ticker := time.NewTicker(opts.refreshInterval)
+	defer ticker.Stop()
+
+	var consecutiveFailures int
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		next, err := opts.revalidate()
+		if err != nil {
+			opts.notify(err)
+
+			consecutiveFailures++
+			if max := opts.refreshOnError.MaxConsecutiveFailures; max > 0 && consecutiveFailures >= max {
+				h.demote()
+				h.state.Store(int32(StatePending))
+			}
+			continue
+		}
+
+		consecutiveFailures = 0
+		h.setHandler(next, true)
+		h.state.Store(int32(StateReady))
+	}
+}
@@ -0,0 +1,128 @@
+package deferred
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func waitForState(t *testing.T, h Handler, want State) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if h.State() == want {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for state %s, got %s", want, h.State())
+}
+
+// TestRefreshDemoteAndRecover drives a full demote-then-recover cycle: a
+// handler created successfully, then demoted back to StatePending after
+// WithRefreshOnError's failure threshold is hit, and finally promoted again
+// once revalidate succeeds. A request that arrives during the demoted
+// window must queue and be served by the recovered handler, not by the
+// stale one a worker happened to have a reference to.
+func TestRefreshDemoteAndRecover(t *testing.T) {
+	var revalCount int32
+	proceed := make(chan struct{})
+
+	create := func() (http.Handler, error) {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("old"))
+		}), nil
+	}
+	revalidate := func() (http.Handler, error) {
+		n := atomic.AddInt32(&revalCount, 1)
+		if n <= 2 {
+			return nil, errors.New("revalidate failed")
+		}
+		<-proceed
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("new"))
+		}), nil
+	}
+
+	h := NewHandler(context.Background(), create,
+		WithRetryAfter(time.Millisecond),
+		WithRevalidate(revalidate),
+		WithRefreshInterval(5*time.Millisecond),
+		WithRefreshOnError(RefreshOnErrorPolicy{MaxConsecutiveFailures: 2}),
+	)
+
+	waitForState(t, h, StateReady)
+	waitForState(t, h, StatePending)
+
+	// Wait for the third revalidate call to start; it blocks on proceed, so
+	// once observed we know the handler is demoted and will stay that way
+	// until this test says otherwise.
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&revalCount) < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if atomic.LoadInt32(&revalCount) < 3 {
+		t.Fatal("revalidate was never retried after demotion")
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	served := make(chan struct{})
+	go func() {
+		h.ServeHTTP(rec, req)
+		close(served)
+	}()
+
+	select {
+	case <-served:
+		t.Fatal("request was served while handler was demoted, instead of waiting to be queued")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(proceed)
+	waitForState(t, h, StateReady)
+
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatal("queued request never completed after handler recovered")
+	}
+	if got := rec.Body.String(); got != "new" {
+		t.Fatalf("queued request served by handler writing %q, want %q (recovered handler)", got, "new")
+	}
+}
+
+// TestWorkersAndRefreshExitOnContextCancel verifies that the queue workers
+// and the revalidation goroutine started by NewHandler actually stop once
+// the context it was given is cancelled, instead of running for the life
+// of the process.
+func TestWorkersAndRefreshExitOnContextCancel(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h := NewHandler(ctx, func() (http.Handler, error) {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), nil
+	},
+		WithRetryAfter(time.Millisecond),
+		WithRevalidate(func() (http.Handler, error) {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), nil
+		}),
+		WithRefreshInterval(time.Millisecond),
+	)
+	waitForState(t, h, StateReady)
+
+	cancel()
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := runtime.NumGoroutine(); got > before {
+		t.Fatalf("goroutines did not wind down after ctx cancellation: before=%d after=%d", before, got)
+	}
+}
@@ -0,0 +1,85 @@
+package deferred
+
+import "net/http"
+
+// State describes where a deferred handler is in its lifecycle.
+type State int
+
+const (
+	// StatePending means the real handler has not been created yet, or was
+	// demoted after repeated WithRevalidate failures, and requests are being
+	// queued.
+	StatePending State = iota
+	// StateReady means the real handler was created successfully and is
+	// now serving requests directly.
+	StateReady
+	// StateFailed means handler creation was permanently abandoned, either
+	// because the context was cancelled or because the Backoff signalled
+	// Stop, and the handler now permanently returns 503.
+	StateFailed
+)
+
+// String returns a human readable name for the state, mainly useful for
+// logging.
+func (s State) String() string {
+	switch s {
+	case StatePending:
+		return "pending"
+	case StateReady:
+		return "ready"
+	case StateFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// Handler is the http.Handler returned by NewHandler, extended with
+// introspection into its lifecycle. It lets operators distinguish "still
+// initializing" from "permanently failed" from outside the handler, for
+// example to drive a load balancer health check.
+type Handler interface {
+	http.Handler
+
+	// State reports whether the handler is still pending creation, ready
+	// to serve, or has permanently failed.
+	State() State
+	// LastError returns the error returned by the most recent failed
+	// creation attempt, or nil if no attempt has failed yet.
+	LastError() error
+	// Attempts returns the number of creation attempts made so far.
+	Attempts() int
+	// ReadinessHandler returns an http.Handler that responds 200 only
+	// while State is StateReady, and 503 otherwise. It is suitable for
+	// mounting as a readiness probe, e.g. at /readyz.
+	ReadinessHandler() http.Handler
+}
+
+// errBox wraps an error so it can be stored in an atomic.Value, which
+// requires every Store call to use the same concrete type.
+type errBox struct{ err error }
+
+func (h *deferredHandler) State() State {
+	return State(h.state.Load())
+}
+
+func (h *deferredHandler) LastError() error {
+	if b, ok := h.lastErr.Load().(errBox); ok {
+		return b.err
+	}
+	return nil
+}
+
+func (h *deferredHandler) Attempts() int {
+	return int(h.attempts.Load())
+}
+
+func (h *deferredHandler) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.State() != StateReady {
+			http.Error(w, "handler not ready", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
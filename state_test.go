@@ -0,0 +1,75 @@
+package deferred
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStateString(t *testing.T) {
+	cases := map[State]string{
+		StatePending: "pending",
+		StateReady:   "ready",
+		StateFailed:  "failed",
+		State(99):    "unknown",
+	}
+	for s, want := range cases {
+		if got := s.String(); got != want {
+			t.Fatalf("State(%d).String() = %q, want %q", s, got, want)
+		}
+	}
+}
+
+func checkReadiness(t *testing.T, h Handler, want int) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ReadinessHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != want {
+		t.Fatalf("ReadinessHandler in state %s: got %d, want %d", h.State(), rec.Code, want)
+	}
+}
+
+func TestReadinessHandlerReflectsState(t *testing.T) {
+	block := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+
+	h := NewHandler(ctx, func() (http.Handler, error) {
+		<-block
+		return nil, errors.New("boom")
+	}, WithRetryAfter(time.Millisecond))
+
+	checkReadiness(t, h, http.StatusServiceUnavailable)
+	if got := h.State(); got != StatePending {
+		t.Fatalf("State() before create returns = %s, want %s", got, StatePending)
+	}
+
+	close(block)
+	time.Sleep(10 * time.Millisecond) // let the failed attempt land
+	cancel()
+
+	waitForState(t, h, StateFailed)
+	checkReadiness(t, h, http.StatusServiceUnavailable)
+
+	if err := h.LastError(); err == nil || err.Error() != "boom" {
+		t.Fatalf("LastError() = %v, want %q", err, "boom")
+	}
+	if attempts := h.Attempts(); attempts < 1 {
+		t.Fatalf("Attempts() = %d, want at least 1", attempts)
+	}
+}
+
+func TestReadinessHandlerReady(t *testing.T) {
+	h := NewHandler(context.Background(), func() (http.Handler, error) {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), nil
+	}, WithRetryAfter(time.Millisecond))
+
+	waitForState(t, h, StateReady)
+	checkReadiness(t, h, http.StatusOK)
+
+	if err := h.LastError(); err != nil {
+		t.Fatalf("LastError() = %v, want nil", err)
+	}
+}